@@ -4,8 +4,10 @@ from __future__ import print_function, unicode_literals
 
 import argparse
 import base64
+import collections
 import copy
 import functools
+import io
 import ipaddress
 import requests
 import json
@@ -14,6 +16,7 @@ import os.path
 import random
 import re
 import string
+import subprocess
 import sys
 import uuid
 
@@ -28,10 +31,10 @@ from OpenSSL import crypto
 from jinja2 import Environment, PackageLoader
 from os.path import exists
 if __package__ is None or __package__ == '':
-    from apic_provision import Apic, ApicKubeConfig
+    from apic_provision import Apic, ApicKubeConfig, aciContainersOwnerAnnotation
     from cloud_provision import CloudProvision
 else:
-    from .apic_provision import Apic, ApicKubeConfig
+    from .apic_provision import Apic, ApicKubeConfig, aciContainersOwnerAnnotation
     from .cloud_provision import CloudProvision
 
 
@@ -54,6 +57,28 @@ VERSION_FIELDS = [
     "openvswitch_version",
 ]
 
+# Tunable parameters exposed in the values.yaml of the Helm chart,
+# with the Helm function used where the value is rendered quoted
+HELM_VALUES = [
+    (("registry", "image_prefix"), "toJson"),
+    (("kube_config", "image_pull_policy"), "toJson"),
+    (("logging", "controller_log_level"), "toJson"),
+    (("logging", "hostagent_log_level"), "toJson"),
+    (("logging", "opflexagent_log_level"), "toJson"),
+    (("net_config", "pod_subnet_chunk_size"), "toJson"),
+    (("kube_config", "max_nodes_svc_graph"), "toJson"),
+    (("kube_config", "snat_operator", "port_range", "ports_per_node"), "quote"),
+]
+
+# Subnets that can be given as an IPv4/IPv6 pair for dual-stack
+DUAL_STACK_SUBNETS = [
+    "node_subnet",
+    "pod_subnet",
+    "extern_dynamic",
+    "extern_static",
+    "node_svc_subnet",
+]
+
 
 FLAVORS_PATH = os.path.dirname(os.path.realpath(__file__)) + "/flavors.yaml"
 VERSIONS_PATH = os.path.dirname(os.path.realpath(__file__)) + "/versions.yaml"
@@ -127,6 +152,7 @@ def config_default():
             "system_id": None,
             "tenant": {
                 "name": None,
+                "peer_clusters": [],
             },
             "use_pre_existing_tenant": False,
             "use_legacy_kube_naming_convention": False,
@@ -205,8 +231,11 @@ def config_default():
             "generate_installer_files": False,
             "generate_cnet_file": False,
             "generate_apic_file": False,
+            "generate_machineconfig_files": False,
             "use_host_netns_volume": False,
             "enable_endpointslice": False,
+            "control_plane_endpoint": None,
+            "run_on_control_plane": False,
         },
         "istio_config": {
             "install_istio": True,
@@ -227,6 +256,8 @@ def config_default():
         },
         "provision": {
             "upgrade_cluster": False,
+            "diff": False,
+            "helm_chart": None,
         },
         "multus": {
             "disable": True,
@@ -314,6 +345,33 @@ def normalize_cidr(cidr):
     return str(n)
 
 
+def config_split_dual_stack(config):
+    # Keep the first family of a dual-stack pair in the usual field so
+    # that single-stack handling is unchanged, the other one is kept in
+    # secondary_subnets
+    secondary = {}
+    for key in DUAL_STACK_SUBNETS:
+        value = config["net_config"].get(key)
+        if isinstance(value, list):
+            config["net_config"][key], secondary[key] = value
+    config["net_config"]["secondary_subnets"] = secondary
+
+
+def split_host_port(endpoint, default_port=6443):
+    # Split "host:port" or "[v6addr]:port" as used by kubeadm's
+    # controlPlaneEndpoint; the port is optional
+    if endpoint.startswith("["):
+        host, _, rest = endpoint[1:].partition("]")
+        if rest and not rest.startswith(":"):
+            raise ValueError("Only a port may follow the address in %s" % endpoint)
+        port = rest[1:] if rest else default_port
+    elif endpoint.count(":") == 1:
+        host, port = endpoint.split(":")
+    else:
+        host, port = endpoint, default_port
+    return host, int(port)
+
+
 def config_adjust(args, config, prov_apic, no_random):
     system_id = config["aci_config"]["system_id"]
     infra_vlan = config["net_config"]["infra_vlan"]
@@ -361,6 +419,8 @@ def config_adjust(args, config, prov_apic, no_random):
     system_namespace = config["kube_config"]["system_namespace"]
     if args.version_token:
         token = args.version_token
+    elif config["provision"].get("diff_token"):
+        token = config["provision"]["diff_token"]
 
     if extern_static:
         static_service_ip_pool = [{"start": cidr_split(extern_static)[0], "end": cidr_split(extern_static)[1]}]
@@ -484,6 +544,42 @@ def config_adjust(args, config, prov_apic, no_random):
         }
     }
 
+    # Dual-stack: the controller gets pools for both families
+    secondary = config["net_config"].get("secondary_subnets", {})
+    kube_config = adj_config["kube_config"]
+    if secondary.get("pod_subnet"):
+        secondary_pod_subnet = secondary["pod_subnet"]
+        kube_config["pod_ip_pool"].append({
+            "start": cidr_split(secondary_pod_subnet)[0],
+            "end": cidr_split(secondary_pod_subnet)[1],
+        })
+        kube_config["pod_network"].append({
+            "subnet": "%s/%s" % cidr_split(secondary_pod_subnet)[3:5],
+            "gateway": cidr_split(secondary_pod_subnet)[2],
+            "routes": [
+                {
+                    "dst": config_set_dst(secondary_pod_subnet),
+                    "gw": cidr_split(secondary_pod_subnet)[2],
+                }
+            ],
+        })
+    if secondary.get("extern_dynamic"):
+        kube_config["service_ip_pool"].append({
+            "start": cidr_split(secondary["extern_dynamic"])[0],
+            "end": cidr_split(secondary["extern_dynamic"])[1],
+        })
+    if secondary.get("extern_static"):
+        kube_config["static_service_ip_pool"].append({
+            "start": cidr_split(secondary["extern_static"])[0],
+            "end": cidr_split(secondary["extern_static"])[1],
+        })
+    if secondary.get("node_svc_subnet"):
+        kube_config["node_service_ip_pool"].append({
+            "start": cidr_split(secondary["node_svc_subnet"])[0],
+            "end": cidr_split(secondary["node_svc_subnet"])[1],
+        })
+        kube_config["node_service_gw_subnets"].append(secondary["node_svc_subnet"])
+
     if config["aci_config"].get("apic_refreshtime"):  # APIC Subscription refresh timeout value
         apic_refreshtime = config["aci_config"]["apic_refreshtime"]
         adj_config["aci_config"]["apic_refreshtime"] = apic_refreshtime
@@ -491,6 +587,11 @@ def config_adjust(args, config, prov_apic, no_random):
     if config["kube_config"].get("ovs_memory_limit"):  # OVS memory limit to be set in K8S Spec
         adj_config["kube_config"]["ovs_memory_limit"] = config["kube_config"]["ovs_memory_limit"]
 
+    if config["kube_config"].get("control_plane_endpoint"):  # API server endpoint used before service routing is up
+        host, port = split_host_port(config["kube_config"]["control_plane_endpoint"])
+        adj_config["kube_config"]["control_plane_endpoint_host"] = host
+        adj_config["kube_config"]["control_plane_endpoint_port"] = port
+
     if config["kube_config"].get("image_pull_policy"):  # imagePullPolicy to be set for ACI CNI pods in K8S Spec
         adj_config["kube_config"]["image_pull_policy"] = config["kube_config"]["image_pull_policy"]
 
@@ -592,6 +693,32 @@ def is_valid_max_nodes_svc_graph(xval):
     raise(Exception("Must be integer between %d and %d" % (xmin, xmax)))
 
 
+def is_valid_control_plane_endpoint(xval):
+    if xval is None:
+        # Not a required field.
+        return True
+    try:
+        host, port = split_host_port(str(xval))
+        if host and 0 < port <= 65535:
+            return True
+    except ValueError:
+        pass
+    raise(Exception("Must be of the form host[:port]"))
+
+
+def is_valid_dual_stack(xval):
+    if not isinstance(xval, list):
+        # Single-stack subnet
+        return True
+    try:
+        versions = set(ipaddress.ip_interface(x).version for x in xval)
+        if len(xval) == 2 and versions == set([4, 6]):
+            return True
+    except ValueError:
+        pass
+    raise(Exception("Must be a list of one IPv4 and one IPv6 subnet"))
+
+
 def is_valid_istio_install_profile(xval):
     if xval is None:
         # Not a required field - default will be set to demo
@@ -710,6 +837,9 @@ def config_validate(flavor_opts, config):
             "kube_config/snat_operator/contract_scope": (get(("kube_config", "snat_operator", "contract_scope")),
                                                          is_valid_contract_scope),
 
+            "kube_config/control_plane_endpoint": (get(("kube_config", "control_plane_endpoint")),
+                                                   is_valid_control_plane_endpoint),
+
             # Network Config
             "net_config/infra_vlan": (get(("net_config", "infra_vlan")),
                                       required),
@@ -770,7 +900,24 @@ def config_validate(flavor_opts, config):
             (get(("aci_config", "vmm_domain", "nested_inside", "installer_provisioned_lb_ip")),
              required)
 
-    if get(("provision", "prov_apic")) is not None:
+    if get(("aci_config", "sync_login", "secret_path")) or \
+            get(("aci_config", "sync_login", "secret_store")):
+        checks["aci_config/sync_login/secret_name"] = \
+            (get(("aci_config", "sync_login", "secret_name")), required)
+        checks["aci_config/sync_login/secret_store"] = \
+            (get(("aci_config", "sync_login", "secret_store")), required)
+        checks["aci_config/sync_login/secret_path"] = \
+            (get(("aci_config", "sync_login", "secret_path")), required)
+
+    if get(("aci_config", "sync_login", "secret_name")) and \
+            flavor_opts.get("template_generator") == "generate_rancher_yaml":
+        checks["aci_config/sync_login/secret_name"] = \
+            (None, lambda x: Raise(Exception("Not supported for Rancher, "
+                                             "the key and cert are always passed inline")))
+
+    if get(("provision", "prov_apic")) is not None or \
+            get(("provision", "validate_apic")) or \
+            (get(("provision", "diff")) and not isOverlay(get(("flavor",)))):
         checks.update({
             # auth for API access
             "aci_config/apic_login/username":
@@ -780,6 +927,14 @@ def config_validate(flavor_opts, config):
         })
 
     checks = deep_merge(checks, extra_checks)
+    for key in DUAL_STACK_SUBNETS:
+        if isinstance(get(("net_config", key)), list):
+            checks["net_config/%s" % key] = \
+                (get(("net_config", key)), is_valid_dual_stack)
+            if flavor_opts.get("template_generator") == "generate_rancher_yaml":
+                checks["net_config/%s" % key] = \
+                    (None, lambda x: Raise(Exception("Dual-stack is not supported for Rancher, "
+                                                     "the network provider takes a single subnet")))
     ret = True
     for k in sorted(checks.keys()):
         value, validator = checks[k]
@@ -845,6 +1000,80 @@ def config_validate_preexisting(config, prov_apic):
     return True
 
 
+def config_validate_apic(config, apic):
+    """Check fabric resources used by the cluster against the APIC.
+
+    Only reads from the APIC. Returns a list of problems, each a dict
+    with the offending resource, its name and a description.
+    """
+    problems = []
+
+    def problem(resource, name, msg):
+        problems.append({"resource": resource, "name": name, "problem": msg})
+
+    aep_name = config["aci_config"]["aep"]
+    if apic.get_aep(aep_name) is None:
+        problem("aep", aep_name, "not defined in the APIC")
+
+    vrf_tenant = config["aci_config"]["vrf"]["tenant"]
+    vrf_name = config["aci_config"]["vrf"]["name"]
+    vrf_dn = config["aci_config"]["vrf"]["dn"]
+    if apic.get_vrf(vrf_dn) is None:
+        problem("vrf", "%s/%s" % (vrf_tenant, vrf_name), "not defined in the APIC")
+
+    l3out_name = config["aci_config"]["l3out"]["name"]
+    if apic.get_l3out(vrf_tenant, l3out_name) is None:
+        problem("l3out", "%s/%s" % (vrf_tenant, l3out_name), "not defined in the APIC")
+    else:
+        for ext_net in config["aci_config"]["l3out"]["external_networks"] or []:
+            if apic.get_l3out_extepg(vrf_tenant, l3out_name, ext_net) is None:
+                problem("l3out/external_networks", "%s/%s/%s" % (vrf_tenant, l3out_name, ext_net),
+                        "not defined in the APIC")
+
+    # The physical domain is created by us; one that already exists
+    # must have been created by a previous run for this cluster
+    phys_name = config["aci_config"]["physical_domain"]["domain"]
+    pdom = apic.get_phys_dom(phys_name)
+    if pdom is not None and \
+            pdom["physDomP"]["attributes"].get("annotation") != aciContainersOwnerAnnotation:
+        problem("physical_domain", phys_name, "already exists and is not managed by acc-provision")
+
+    nested_name = config["aci_config"]["vmm_domain"]["nested_inside"].get("name")
+    if nested_name:
+        nested_type = ApicKubeConfig(config).get_nested_domain_type()
+        if apic.get_vmm_dom(nested_type, nested_name) is None:
+            problem("vmm_domain/nested_inside", "%s/%s" % (nested_type, nested_name),
+                    "not defined in the APIC")
+
+    # VLANs must not be handed out by pools that belong to other
+    # clusters or other fabric users
+    vlans = [
+        ("net_config/kubeapi_vlan", config["net_config"]["kubeapi_vlan"], config["net_config"]["kubeapi_vlan"]),
+        ("net_config/service_vlan", config["net_config"]["service_vlan"], config["net_config"]["service_vlan"]),
+    ]
+    if config["aci_config"]["vmm_domain"]["encap_type"] == "vlan":
+        vlan_range = config["aci_config"]["vmm_domain"]["vlan_range"]
+        vlans.append(("aci_config/vmm_domain/vlan_range", vlan_range["start"], vlan_range["end"]))
+    own_pools = [
+        config["aci_config"]["physical_domain"]["vlan_pool"],
+        config["aci_config"]["vmm_domain"]["vlan_pool"],
+    ]
+    for blk in apic.get_vlan_encap_blocks():
+        attrs = blk["fvnsEncapBlk"]["attributes"]
+        m = re.match(r"uni/infra/vlanns-\[(.*)\]-(static|dynamic)/", attrs["dn"])
+        if m is None or m.group(1) in own_pools:
+            continue
+        blk_start = int(attrs["from"].split("-")[1])
+        blk_end = int(attrs["to"].split("-")[1])
+        for field, start, end in vlans:
+            if start is None or end is None:
+                continue
+            if int(start) <= blk_end and blk_start <= int(end):
+                problem("vlan", field, "overlaps %s-%s in VLAN pool %s" %
+                        (attrs["from"], attrs["to"], m.group(1)))
+    return problems
+
+
 def generate_sample(filep, flavor):
     if flavor in ["cloud", "eks"]:
         data = pkgutil.get_data('acc_provision', 'templates/overlay-provision-config.yaml')
@@ -955,11 +1184,12 @@ def generate_operator_tar(tar_path, cont_docs, config):
 
     gen_file_list(cont_docs, file_start, filenames)
 
-    # Create three extra files needed for Openshift 4.3 installer
+    # Create extra files needed for Openshift 4.x installer
     extra_files = []
     gen_inst_files = config["kube_config"]["generate_installer_files"]
     gen_cnet_file = config["kube_config"]["generate_cnet_file"]
     gen_apic_file = config["kube_config"]["generate_apic_file"]
+    gen_mc_files = config["kube_config"]["generate_machineconfig_files"]
     if (config['multus']['disable'] is True) and (gen_inst_files or gen_cnet_file):
         cnetfile_name = 'cluster-network-03-config.yaml'
         extra_files.append(cnetfile_name)
@@ -970,6 +1200,11 @@ def generate_operator_tar(tar_path, cont_docs, config):
         extra_files.append(masterfile_name)
         extra_files.append(workerfile_name)
 
+    # MachineConfigs for the host agent prerequisites on RHCOS nodes
+    if gen_mc_files:
+        extra_files.append('99-master-aci-host-prereqs.yaml')
+        extra_files.append('99-worker-aci-host-prereqs.yaml')
+
     if gen_apic_file:
         apic_name = 'apic.json'
         extra_files.append(apic_name)
@@ -988,6 +1223,9 @@ def generate_operator_tar(tar_path, cont_docs, config):
 
 
 def generate_rancher_yaml(config, operator_output, operator_tar, operator_cr_output):
+    if config["provision"]["diff"]:
+        info("Skipping kubernetes comparison, not supported for Rancher")
+        return
     if operator_output and operator_output != "/dev/null":
         template = get_jinja_template('aci-network-provider-cluster.yaml')
         outname = operator_output
@@ -1010,6 +1248,121 @@ def generate_rancher_yaml(config, operator_output, operator_tar, operator_cr_out
             template.stream(config=config).dump(operator_output)
 
 
+def kube_yaml_resources(docs):
+    resources = collections.OrderedDict()
+    for doc in docs:
+        if not doc:
+            continue
+        meta = doc.get("metadata", {})
+        name = meta.get("name")
+        if meta.get("namespace"):
+            name = meta["namespace"] + "/" + name
+        resources["%s %s" % (doc["kind"], name)] = doc
+    return resources
+
+
+def get_kube_yaml_token(kube_file):
+    # Reuse the version token of an existing deployment so that
+    # unchanged resources compare equal
+    if not exists(kube_file):
+        return None
+    with open(kube_file, "r") as fh:
+        for doc in yaml.load_all(fh, Loader=yaml.SafeLoader):
+            if doc:
+                labels = doc.get("metadata", {}).get("labels") or {}
+                if "aci-containers-config-version" in labels:
+                    return labels["aci-containers-config-version"]
+    return None
+
+
+def get_kube_yaml_cert(kube_file):
+    # Reuse the user key and cert of an existing deployment when the
+    # cert files are not around; without one the Secret shows up as
+    # changed
+    if exists(kube_file):
+        with open(kube_file, "r") as fh:
+            for doc in yaml.load_all(fh, Loader=yaml.SafeLoader):
+                if doc and doc["kind"] == "Secret" and doc["metadata"]["name"] == "aci-user-cert":
+                    data = doc.get("data") or {}
+                    return (base64.b64decode(data.get("user.key", "")),
+                            base64.b64decode(data.get("user.crt", "")))
+    return b"", b""
+
+
+def diff_kube_yaml(kube_file, new_deployment_file):
+    current = collections.OrderedDict()
+    if exists(kube_file):
+        with open(kube_file, "r") as fh:
+            current = kube_yaml_resources(yaml.load_all(fh, Loader=yaml.SafeLoader))
+    desired = kube_yaml_resources(yaml.load_all(new_deployment_file, Loader=yaml.SafeLoader))
+
+    ret = []
+    for key, doc in desired.items():
+        if key not in current:
+            ret.append("+ %s" % key)
+        elif current[key] != doc:
+            ret.append("~ %s" % key)
+    for key in current:
+        if key not in desired:
+            ret.append("- %s" % key)
+    return ret
+
+
+def generate_helm_chart(chart_path, config):
+    # Render the deployment with a placeholder for each tunable value
+    # and turn the placeholders into references to .Values
+    helm_values = list(HELM_VALUES)
+    for key in config["registry"]:
+        if key.endswith("_version") and key != "configuration_version":
+            helm_values.append((("registry", key), "toJson"))
+
+    helm_config = copy.deepcopy(config)
+    values = {}
+    placeholders = {}
+    for path, quoted in helm_values:
+        cfg, vals = helm_config, values
+        for key in path[:-1]:
+            cfg = cfg[key]
+            vals = vals.setdefault(key, {})
+        if path[-1] not in cfg:
+            continue
+        vals[path[-1]] = cfg[path[-1]]
+        name = ".".join(path)
+        cfg[path[-1]] = "@@helm:%s@@" % name
+        placeholders[name] = quoted
+
+    template = get_jinja_template('aci-containers.yaml')
+    deployment = template.render(config=helm_config)
+    for name, quoted in placeholders.items():
+        deployment = deployment.replace(
+            '"@@helm:%s@@"' % name, "{{ .Values.%s | %s }}" % (name, quoted))
+        deployment = deployment.replace(
+            "@@helm:%s@@" % name, "{{ .Values.%s }}" % name)
+
+    version = str(config["registry"].get("version", "0.0"))
+    chart = {
+        "apiVersion": "v2",
+        "name": "aci-containers",
+        "description": "ACI CNI for cluster %s, generated by acc-provision" %
+                       config["aci_config"]["system_id"],
+        "type": "application",
+        "version": ".".join((version.split(".") + ["0", "0"])[:3]),
+        "appVersion": version,
+    }
+    files = [
+        ("aci-containers/Chart.yaml", yaml.safe_dump(chart, default_flow_style=False)),
+        ("aci-containers/values.yaml", yaml.safe_dump(values, default_flow_style=False)),
+        ("aci-containers/templates/aci-containers.yaml", deployment),
+    ]
+    tar = tarfile.open(chart_path, "w:gz", encoding="utf-8")
+    for name, data in files:
+        data = data.encode("utf-8")
+        tarinfo = tarfile.TarInfo(name)
+        tarinfo.size = len(data)
+        tar.addfile(tarinfo, io.BytesIO(data))
+    tar.close()
+
+
 def generate_kube_yaml(config, operator_output, operator_tar, operator_cr_output):
     kube_objects = [
         "configmap", "secret", "serviceaccount",
@@ -1064,12 +1417,19 @@ def generate_kube_yaml(config, operator_output, operator_tar, operator_cr_output
         else:
             new_deployment_file = temp
 
+        if config["provision"]["diff"]:
+            info("Comparing kubernetes deployment with %s" % outname)
+            for line in diff_kube_yaml(operator_output, new_deployment_file):
+                print(line)
+            return config
+
         if operator_output != sys.stdout:
             with open(operator_output, "w") as fh:
                 fh.write(new_deployment_file)
         else:
             op_template.stream(config=config).dump(operator_output)
 
+        external_path = None
         if config["flavor"] != "k8s-overlay":
             # The next few files are to generate tar file with each
             # containers and operator yaml in separate file. This is needed
@@ -1080,8 +1440,16 @@ def generate_kube_yaml(config, operator_output, operator_tar, operator_cr_output
             if tar_path == "-":
                 tar_path = "/dev/null"
             else:
-                deployment_docs = yaml.load_all(new_deployment_file, Loader=yaml.SafeLoader)
-                generate_operator_tar(tar_path, deployment_docs, config)
+                deployment_docs = [doc for doc in yaml.load_all(new_deployment_file, Loader=yaml.SafeLoader) if doc]
+                # The ExternalSecret kind only exists once the External
+                # Secrets Operator is installed, which is never the case
+                # while the OpenShift installer applies the tar
+                external_docs = [doc for doc in deployment_docs if doc["kind"] == "ExternalSecret"]
+                generate_operator_tar(tar_path, [doc for doc in deployment_docs if doc["kind"] != "ExternalSecret"], config)
+                if external_docs and tar_path != "/dev/null":
+                    external_path = re.sub(r"(\.tar\.gz|\.tgz)$", "", tar_path) + "-external-secret.yaml"
+                    with open(external_path, "w") as fh:
+                        yaml.safe_dump_all(external_docs, fh, default_flow_style=False)
 
             op_cr_template = get_jinja_template('aci-operators-cr.yaml')
             if operator_cr_output and operator_cr_output != "/dev/null":
@@ -1091,9 +1459,18 @@ def generate_kube_yaml(config, operator_output, operator_tar, operator_cr_output
                     info("Writing kubernetes ACI operator CR to %s" % operator_cr_output)
             op_cr_template.stream(config=config).dump(operator_cr_output)
 
+        helm_chart = config["provision"]["helm_chart"]
+        if helm_chart:
+            generate_helm_chart(helm_chart, config)
+
         info("Writing kubernetes infrastructure YAML to %s" % outname)
         if config["flavor"] != "k8s-overlay":
             info("Writing ACI CNI operator tar to %s" % tar_path)
+        if external_path:
+            info("Writing ExternalSecret to %s, apply it once the External "
+                 "Secrets Operator is installed" % external_path)
+        if helm_chart:
+            info("Writing Helm chart to %s" % helm_chart)
         info("Apply infrastructure YAML using:")
         info("  %s apply -f %s" %
              (config["kube_config"]["kubectl"], applyname))
@@ -1125,24 +1502,59 @@ def generate_apic_config(flavor_opts, config, prov_apic, apic_file):
 
     ret = True
     sync_login = config["aci_config"]["sync_login"]["username"]
+    system_id = config["aci_config"]["system_id"]
+    cluster_tenant = config["aci_config"]["cluster_tenant"]
+    if config["provision"]["diff"]:
+        apic = get_apic(config)
+        if apic is None:
+            err("Not able to login to the APIC, please check username or password")
+            return False
+        info("Comparing apic configuration with APIC")
+        adds, changes = apic.diff(apic_config)
+        for path, _ in adds:
+            print("+ %s" % path)
+        for path, _ in changes:
+            print("~ %s" % path)
+        for path in apic.get_stale(apic_config, system_id, cluster_tenant):
+            print("- %s" % path)
+        return False if apic.errors > 0 else True
+
     if prov_apic is not None:
         apic = get_apic(config)
         if apic is not None:
-            if prov_apic is True:
+            if prov_apic is True and config["provision"]["upgrade_cluster"]:
+                info("Provisioning configuration changes in APIC")
+                adds, changes = apic.diff(apic_config)
+                stale = apic.get_stale(apic_config, system_id, cluster_tenant)
+                apic.provision_delta(adds + changes, stale)
+            elif prov_apic is True:
                 info("Provisioning configuration in APIC")
                 apic.provision(apic_config, sync_login)
             if prov_apic is False:
                 info("Unprovisioning configuration in APIC")
-                system_id = config["aci_config"]["system_id"]
                 tenant = config["aci_config"]["vrf"]["tenant"]
                 vrf_tenant = config["aci_config"]["vrf"]["tenant"]
-                cluster_tenant = config["aci_config"]["cluster_tenant"]
                 old_naming = config["aci_config"]["use_legacy_kube_naming_convention"]
                 apic.unprovision(apic_config, system_id, tenant, vrf_tenant, cluster_tenant, old_naming)
+                deleted = list(collections.OrderedDict.fromkeys(apic.deleted))
+                info("Removed %d objects from APIC" % len(deleted))
+                for dn in deleted:
+                    info("  %s" % dn)
             ret = False if apic.errors > 0 else True
     return ret
 
 
+def delete_kube_resources(config, kube_file):
+    kubectl = config["kube_config"]["kubectl"]
+    info("Deleting kubernetes resources in %s" % kube_file)
+    try:
+        subprocess.check_call([kubectl, "delete", "--ignore-not-found", "-f", kube_file])
+    except (OSError, subprocess.CalledProcessError) as e:
+        err("Error in deleting kubernetes resources: %s" % str(e))
+        return False
+    return True
+
+
 def get_apic(config):
     apic_host = config["aci_config"]["apic_hosts"][0]
     apic_username = config["aci_config"]["apic_login"]["username"]
@@ -1206,12 +1618,24 @@ def parse_args(show_help):
     parser.add_argument(
         '-r', '--aci_operator_cr', default="-", metavar='file',
         help='output file for your aci-operator deployment custom resource')
+    parser.add_argument(
+        '--helm-chart', default=None, metavar='file',
+        help='with -o, also output a Helm chart (.tgz) for your kubernetes deployment')
     parser.add_argument(
         '-a', '--apic', action='store_true', default=False,
         help='create/validate the required APIC resources')
     parser.add_argument(
         '-d', '--delete', action='store_true', default=False,
         help='delete the APIC resources that would have been created')
+    parser.add_argument(
+        '--delete-kube', action='store_true', default=False,
+        help='with -d, also delete the kubernetes resources in the -o deployment file')
+    parser.add_argument(
+        '--validate', action='store_true', default=False,
+        help='check the fabric configuration against the APIC, no changes are made')
+    parser.add_argument(
+        '--diff', action='store_true', default=False,
+        help='show the APIC and kubernetes changes against the existing deployment, no changes are made')
     parser.add_argument(
         '-u', '--username', default=None, metavar='name',
         help='apic-admin username to use for APIC API access')
@@ -1241,7 +1665,7 @@ def parse_args(show_help):
         help='skip kafka certificate generation')
     parser.add_argument(
         '--upgrade', action='store_true', default=False,
-        help='generate kubernetes deployment file for cluster upgrade')
+        help='generate kubernetes deployment file for cluster upgrade, with -a only apply the APIC changes')
     parser.add_argument(
         '--disable-multus', default='true', metavar='disable_multus',
         help='true/false to disable/enable multus in cluster')
@@ -1286,20 +1710,144 @@ def check_overlapping_subnets(config):
     if config["net_config"]["extern_static"]:
         subnet_info["extern_static"] = config["net_config"]["extern_static"]
 
+    for key, subnet in config["net_config"].get("secondary_subnets", {}).items():
+        subnet_info[key + "_secondary"] = subnet
+
     for sub1, sub2 in combinations(subnet_info.values(), r=2):
-        # Checking if sub1 and sub2 are IPv4 or IPv6
-        rtr1, _ = sub1.split("/")
-        ip1 = ipaddress.ip_address(rtr1)
-        if ip1.version == 4:
-            net1, net2 = ipaddress.IPv4Network(sub1, strict=False), ipaddress.IPv4Network(sub2, strict=False)
-        else:
-            net1, net2 = ipaddress.IPv6Network(sub1, strict=False), ipaddress.IPv6Network(sub2, strict=False)
+        net1, net2 = ipaddress.ip_network(sub1, strict=False), ipaddress.ip_network(sub2, strict=False)
+        # Subnets of different families never overlap
+        if net1.version != net2.version:
+            continue
         out = net1.overlaps(net2)
         if out:
             return False
     return True
 
 
+def config_peer_clusters(config, config_file):
+    # Load the input files of the other clusters sharing the tenant,
+    # relative paths are relative to our own input file
+    peers = []
+    base_dir = os.path.dirname(config_file) if config_file else ""
+    for peer in config["aci_config"]["tenant"]["peer_clusters"]:
+        if not isinstance(peer, dict) or not peer.get("config"):
+            err("Missing config file in aci_config/tenant/peer_clusters entry: %s" % peer)
+            return None
+        peer_file = os.path.join(base_dir, peer["config"])
+        try:
+            peer_config = config_user(peer_file)
+        except Exception as e:
+            err("Unable to load peer cluster configuration %s: %s" % (peer_file, e))
+            return None
+        peer_aci_config = peer_config.get("aci_config", {})
+        # The clusters the peer lets its pods talk to, it only provides
+        # its inter-cluster contract to those
+        allow_traffic_from = []
+        peer_dir = os.path.dirname(peer_file)
+        for peer_peer in peer_aci_config.get("tenant", {}).get("peer_clusters") or []:
+            if isinstance(peer_peer, dict) and peer_peer.get("config") and peer_peer.get("allow_traffic"):
+                peer_peer_file = os.path.join(peer_dir, peer_peer["config"])
+                try:
+                    peer_peer_config = config_user(peer_peer_file)
+                except Exception as e:
+                    err("Unable to load peer cluster configuration %s: %s" % (peer_peer_file, e))
+                    return None
+                allow_traffic_from.append(peer_peer_config.get("aci_config", {}).get("system_id"))
+        peers.append({
+            "system_id": peer_aci_config.get("system_id"),
+            "tenant": peer_aci_config.get("tenant", {}).get("name"),
+            "net_config": peer_config.get("net_config", {}),
+            "vmm_domain": deep_merge(peer_aci_config.get("vmm_domain", {}),
+                                     config_default()["aci_config"]["vmm_domain"]),
+            "allow_traffic": peer.get("allow_traffic", False),
+            "allow_traffic_from": allow_traffic_from,
+        })
+    return peers
+
+
+def check_peer_clusters(config, peers):
+    """Check for VLAN and subnet collisions with the clusters sharing the tenant."""
+    if peers and not config["aci_config"]["tenant"]["name"]:
+        err("aci_config/tenant/peer_clusters needs a shared tenant in aci_config/tenant/name")
+        return False
+
+    def subnets(net_config):
+        ret = []
+        for key in DUAL_STACK_SUBNETS:
+            value = net_config.get(key)
+            for subnet in (value if isinstance(value, list) else [value]):
+                if subnet:
+                    ret.append((key, ipaddress.ip_network(subnet, strict=False)))
+        return ret
+
+    def vlan_ranges(net_config, vmm_domain):
+        ret = []
+        for key in ["kubeapi_vlan", "service_vlan"]:
+            if net_config.get(key):
+                ret.append(("net_config/%s" % key, int(net_config[key]), int(net_config[key])))
+        vlan_range = vmm_domain.get("vlan_range") or {}
+        if vmm_domain.get("encap_type") == "vlan" and vlan_range.get("start") and vlan_range.get("end"):
+            ret.append(("aci_config/vmm_domain/vlan_range", int(vlan_range["start"]), int(vlan_range["end"])))
+        return ret
+
+    net_config = dict(config["net_config"])
+    for key, subnet in config["net_config"]["secondary_subnets"].items():
+        net_config[key] = [net_config[key], subnet]
+    vmm_domain = config["aci_config"]["vmm_domain"]
+
+    ret = True
+    system_id = config["aci_config"]["system_id"]
+    tenant = config["aci_config"]["tenant"]["name"]
+    for peer in peers:
+        peer_id = peer["system_id"]
+        if peer["tenant"] != tenant:
+            err("Cluster %s is in tenant %s, not in %s" % (peer_id, peer["tenant"], tenant))
+            ret = False
+        if peer_id == system_id:
+            err("Cluster %s sharing the tenant uses the same system_id" % peer_id)
+            ret = False
+        elif peer_id and (peer_id.startswith(system_id + "-") or system_id.startswith(peer_id + "-")):
+            # Object names are <prefix><system_id>-<suffix>, so these
+            # could not be told apart
+            err("Cluster %s sharing the tenant: system_id %s must not be a prefix of %s" %
+                (peer_id, min(peer_id, system_id, key=len), max(peer_id, system_id, key=len)))
+            ret = False
+        if peer["allow_traffic"] and system_id not in peer["allow_traffic_from"]:
+            err("Cluster %s does not allow traffic from %s, set allow_traffic for %s in its peer_clusters too" %
+                (peer_id, system_id, system_id))
+            ret = False
+        for field, start, end in vlan_ranges(net_config, vmm_domain):
+            for _, peer_start, peer_end in vlan_ranges(peer["net_config"], peer["vmm_domain"]):
+                if start <= peer_end and peer_start <= end:
+                    err("%s %s is also used by cluster %s" %
+                        (field, start if start == end else "%s-%s" % (start, end), peer_id))
+                    ret = False
+        try:
+            mcast_range = vmm_domain["mcast_range"]
+            peer_mcast_range = peer["vmm_domain"]["mcast_range"]
+            if ipaddress.ip_address(mcast_range["start"]) <= ipaddress.ip_address(peer_mcast_range["end"]) and \
+                    ipaddress.ip_address(peer_mcast_range["start"]) <= ipaddress.ip_address(mcast_range["end"]):
+                err("aci_config/vmm_domain/mcast_range %s-%s overlaps %s-%s of cluster %s" %
+                    (mcast_range["start"], mcast_range["end"],
+                     peer_mcast_range["start"], peer_mcast_range["end"], peer_id))
+                ret = False
+        except (KeyError, TypeError, ValueError) as e:
+            err("Invalid aci_config/vmm_domain/mcast_range of cluster %s: %s" % (peer_id, e))
+            ret = False
+        try:
+            peer_subnets = subnets(peer["net_config"])
+        except ValueError as e:
+            err("Invalid net_config of cluster %s: %s" % (peer_id, e))
+            ret = False
+            continue
+        for key, subnet in subnets(net_config):
+            for peer_key, peer_subnet in peer_subnets:
+                if subnet.version == peer_subnet.version and subnet.overlaps(peer_subnet):
+                    err("net_config/%s %s overlaps %s of cluster %s" % (key, subnet, peer_key, peer_id))
+                    ret = False
+    return ret
+
+
 def provision(args, apic_file, no_random):
     config_file = args.config
     output_file = args.output
@@ -1322,6 +1870,16 @@ def provision(args, apic_file, no_random):
             # ignore that timeout value
             warn("Invalid timeout value ignored: '%s'" % timeout)
 
+    delete_kube_file = None
+    if args.delete_kube:
+        if not args.delete or args.output == "-":
+            err("--delete-kube needs -d and the kubernetes deployment file, use -o")
+            return False
+        if args.flavor == "k8s-overlay" or args.flavor in ["cloud", "aks", "eks"]:
+            err("--delete-kube is not supported for flavor %s" % args.flavor)
+            return False
+        delete_kube_file = args.output
+
     generate_cert_data = True
     if args.delete:
         output_file = "/dev/null"
@@ -1347,9 +1905,41 @@ def provision(args, apic_file, no_random):
             "debug_apic": args.debug,
             "save_to": args.test_data_out,
             "skip-kafka-certs": args.skip_kafka_certs,
+            "validate_apic": args.validate,
+            "diff": args.diff,
+            "helm_chart": args.helm_chart,
         },
     }
 
+    if args.validate and (prov_apic is not None or args.diff):
+        err("--validate cannot be combined with -a, -d or --diff")
+        return False
+
+    if args.diff:
+        if prov_apic is not None:
+            err("--diff cannot be combined with -a or -d")
+            return False
+        if args.flavor in ["cloud", "aks", "eks"]:
+            err("--diff is not supported for flavor %s" % args.flavor)
+            return False
+        if output_file == "-":
+            err("--diff needs the existing kubernetes deployment file, use -o")
+            return False
+        if not args.version_token:
+            config["provision"]["diff_token"] = get_kube_yaml_token(output_file)
+        generate_cert_data = False
+
+    if args.helm_chart:
+        if args.delete:
+            err("--helm-chart cannot be combined with -d")
+            return False
+        if output_file == "-":
+            err("--helm-chart needs the kubernetes deployment file, use -o")
+            return False
+        if FLAVORS.get(args.flavor, {}).get("options", {}).get("template_generator") == "generate_rancher_yaml":
+            err("--helm-chart is not supported for flavor %s" % args.flavor)
+            return False
+
     if upgrade_cluster:
         output_tar = "/dev/null"
         config["provision"]["upgrade_cluster"] = True
@@ -1433,11 +2023,21 @@ def provision(args, apic_file, no_random):
     except Exception as ex:
         print("%s") % ex
 
+    config_split_dual_stack(config)
+
     # Verify if overlapping subnet present in config input file
     if not check_overlapping_subnets(config):
         err("overlapping subnets found in configuration input file")
         return False
 
+    # Verify the clusters sharing the tenant do not collide with this one
+    peers = config_peer_clusters(config, config_file)
+    if peers is None or not check_peer_clusters(config, peers):
+        err("collisions found with clusters sharing the tenant")
+        return False
+    config["aci_config"]["tenant"]["inter_cluster_peers"] = \
+        [peer["system_id"] for peer in peers if peer["allow_traffic"]]
+
     # Adjust config based on convention/apic data
     adj_config = config_adjust(args, config, prov_apic, no_random)
     deep_merge(config, adj_config)
@@ -1447,6 +2047,23 @@ def provision(args, apic_file, no_random):
         # Ignore failures, this check is just advisory for now
         pass
 
+    # Read-only check of the fabric resources, nothing is generated
+    if args.validate:
+        if isOverlay(flavor):
+            err("APIC validation is not supported for flavor %s" % flavor)
+            return False
+        apic = get_apic(config)
+        if apic is None:
+            err("Not able to login to the APIC, please check username or password")
+            return False
+        problems = config_validate_apic(config, apic)
+        print(json_indent(problems))
+        if problems:
+            err("%d problem(s) found in APIC validation" % len(problems))
+            return False
+        info("APIC validation found no problems")
+        return True
+
     # generate key and cert if needed
     username = config["aci_config"]["sync_login"]["username"]
     certfile = config["aci_config"]["sync_login"]["certfile"]
@@ -1455,6 +2072,21 @@ def provision(args, apic_file, no_random):
     reused = True
     if generate_cert_data:
         key_data, cert_data, reused = generate_cert(username, certfile, keyfile)
+        sync_login = config["aci_config"]["sync_login"]
+        if sync_login.get("secret_path") and flavor != "k8s-overlay":
+            info("Secret \"%s\" is synced from \"%s\" in store \"%s\"; store \"%s\" "
+                 "and \"%s\" there as properties user.key and user.crt" %
+                 (sync_login["secret_name"], sync_login["secret_path"], sync_login["secret_store"],
+                  keyfile, certfile))
+        elif sync_login.get("secret_name") and flavor != "k8s-overlay":
+            info("Using externally managed Secret \"%s\"; store \"%s\" and "
+                 "\"%s\" in it as user.key and user.crt" %
+                 (sync_login["secret_name"], keyfile, certfile))
+    elif args.diff and exists(certfile) and exists(keyfile):
+        # Compare with the existing certs, but never create them
+        key_data, cert_data, reused = generate_cert(username, certfile, keyfile)
+    elif args.diff:
+        key_data, cert_data = get_kube_yaml_cert(output_file)
     config["aci_config"]["sync_login"]["key_data"] = key_data
     config["aci_config"]["sync_login"]["cert_data"] = cert_data
     config["aci_config"]["sync_login"]["cert_reused"] = reused
@@ -1485,8 +2117,12 @@ def provision(args, apic_file, no_random):
         apic = get_apic(config)
         nested_vswitch_vlanpool = apic.get_vmmdom_vlanpool_tDn(config['aci_config']['vmm_domain']['nested_inside']['name'])
         config['aci_config']['vmm_domain']['nested_inside']['vlan_pool'] = nested_vswitch_vlanpool
-    ret = generate_apic_config(flavor_opts, config, prov_apic, apic_file)
-    return ret
+    # Remove the cluster first so the controller does not recreate
+    # the APIC objects being deleted
+    ret = True
+    if delete_kube_file:
+        ret = delete_kube_resources(config, delete_kube_file)
+    return generate_apic_config(flavor_opts, config, prov_apic, apic_file) and ret
 
 
 def main(args=None, apic_file=None, no_random=False):
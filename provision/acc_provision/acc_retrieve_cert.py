@@ -20,7 +20,7 @@ def err(msg):
     print("ERR:  " + msg, file=sys.stderr)
 
 
-def kubectl(kind, name, namespace=None):
+def kubectl(kind, name, namespace=None, field='data'):
     ret = None
     cmd = ['kubectl', 'get', '-o', 'json']
     cmd.extend([kind, name])
@@ -30,7 +30,7 @@ def kubectl(kind, name, namespace=None):
         cmd.extend(['--kubeconfig', KUBECONFIG])
     retstr = subprocess.check_output(cmd, stderr=subprocess.STDOUT)
     if retstr:
-        ret = json.loads(retstr).get('data')
+        ret = json.loads(retstr).get(field)
     return ret
 
 
@@ -53,6 +53,21 @@ def get_sysid(name, namespace):
     return ret
 
 
+def get_cert_secret_name(name, namespace):
+    # The Secret mounted by the controller, which is not aci-user-cert
+    # when acc-provision was given sync_login/secret_name
+    ret = None
+    try:
+        spec = kubectl('deployment', name, namespace, 'spec')
+    except Exception:
+        return ret
+    volumes = spec and spec.get('template', {}).get('spec', {}).get('volumes')
+    for volume in volumes or []:
+        if volume.get('name') == 'aci-user-cert-volume':
+            ret = volume.get('secret', {}).get('secretName')
+    return ret
+
+
 def retrieve_certs(sysid, name, namespace=None):
     key, crt = get_secret(name, namespace, 'user.key', 'user.crt')
     for k, v in zip(['key', 'crt'], [key, crt]):
@@ -83,6 +98,10 @@ def parse_args():
     parser.add_argument(
         '-k', '--kubeconfig', default=None, metavar='file',
         help='Path to the kubeconfig file if different from default')
+    parser.add_argument(
+        '-s', '--secret', default=None, metavar='name',
+        help='Secret holding the certificate and key if different from the '
+        'one mounted by the controller')
 
     return parser.parse_args()
 
@@ -104,17 +123,20 @@ def main(args=None):
     namespace_os = 'aci-containers-system'
     namespace_kube = 'kube-system'
     config_name = 'aci-containers-config'
-    secret_name = 'aci-user-cert'
+    deployment_name = 'aci-containers-controller'
+    secret_name = lambda ns: (args.secret or
+                              get_cert_secret_name(deployment_name, ns) or
+                              'aci-user-cert')
 
     try:
         sysid = get_sysid(config_name, namespace_os)
         if sysid:
-            retrieve_certs(sysid, secret_name, namespace_os)
+            retrieve_certs(sysid, secret_name(namespace_os), namespace_os)
     except Exception:
         try:
             sysid = get_sysid(config_name, namespace_kube)
             if sysid:
-                retrieve_certs(sysid, secret_name, namespace_kube)
+                retrieve_certs(sysid, secret_name(namespace_kube), namespace_kube)
         except Exception as e:
             err(repr(e))
             err("Couldn't find the required secret files in either aci-containers-system or kube-system.")
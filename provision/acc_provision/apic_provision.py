@@ -63,10 +63,124 @@ def aci_obj(klass, pair_list):
     return data
 
 
+def cluster_names(system_id):
+    """Names of the objects generated for system_id, outside of user config"""
+    names = set([system_id, aci_prefix + system_id])
+    for suffix in ["pdom", "pool", "vpool", "mpool", "l3out-allow-all", "allow-all-filter"]:
+        names.add("%s-%s" % (system_id, suffix))
+    for suffix in Apic.CLUSTER_SUFFIXES:
+        names.add("%s%s-%s" % (aci_prefix, system_id, suffix))
+    return names
+
+
+def aci_obj_names(data, classes):
+    """Names of the objects of the given classes in the generated config"""
+    names = set()
+
+    def walk(obj):
+        for klass, mo in obj.items():
+            name = mo.get("attributes", {}).get("name")
+            if klass in classes and name:
+                names.add(name)
+            for child in mo.get("children", []):
+                walk(child)
+
+    for path, config in data:
+        if config is not None:
+            walk(json.loads(config))
+    return names
+
+
+def path_dn(path):
+    """Map /api/mo/<dn>.json and /api/node/mo/<dn>.json to the dn"""
+    dn = path.split("?")[0]
+    for prefix in ["/api/node/mo/", "/api/mo/"]:
+        if dn.startswith(prefix):
+            dn = dn[len(prefix):]
+    if dn.endswith(".json"):
+        dn = dn[:-len(".json")]
+    return dn
+
+
+# Relative names of the classes that are posted to their parent's
+# path, and of the tenant children that are compared one by one
+DIFF_RNS = {
+    "infraAttEntityP": "attentp-%(name)s",
+    "infraSetPol": "settings",
+    "fvRsProv": "rsprov-%(tnVzBrCPName)s",
+    "fvRsDomAtt": "rsdomAtt-[%(tDn)s]",
+}
+TENANT_CHILD_RNS = {
+    "fvBD": "BD-%(name)s",
+    "fvAp": "ap-%(name)s",
+    "vzFilter": "flt-%(name)s",
+    "vzBrCP": "brc-%(name)s",
+    "ndPfxPol": "ndpfxpol-%(name)s",
+}
+
+
+def diff_units(path, body):
+    """Split a post into (path, object) pairs, each path getting back that object"""
+    dn = path_dn(path)
+    units = []
+    for klass, mo in body.items():
+        obj = collections.OrderedDict([(klass, mo)])
+        if klass in DIFF_RNS:
+            rn = DIFF_RNS[klass] % mo["attributes"]
+            units.append(("/api/mo/%s/%s.json" % (dn, rn), obj))
+        elif klass == "fvTenant":
+            # Compare the tenant itself, then each child at its own dn
+            # instead of the full subtree of a possibly shared tenant
+            others = []
+            for child in mo.get("children", []):
+                child_klass = list(child.keys())[0]
+                if child_klass in TENANT_CHILD_RNS:
+                    rn = TENANT_CHILD_RNS[child_klass] % child[child_klass]["attributes"]
+                    units.append(("/api/mo/%s/%s.json" % (dn, rn), child))
+                else:
+                    others.append(child)
+            tenant = collections.OrderedDict([("attributes", mo["attributes"])])
+            if others:
+                tenant["children"] = others
+            units.insert(0, (path, collections.OrderedDict([(klass, tenant)])))
+        else:
+            units.append((path, obj))
+    return units
+
+
+def aci_obj_contains(current, desired):
+    """Check that every attribute and child of desired is also in current"""
+    for klass, mo in desired.items():
+        if klass not in current:
+            return False
+        cur_attrs = current[klass].get("attributes", {})
+        for k, v in mo.get("attributes", {}).items():
+            # dn and status are not config, pwd is never returned by APIC
+            if k in ["dn", "status", "pwd"]:
+                continue
+            if k not in cur_attrs or str(cur_attrs[k]) != str(v):
+                return False
+        cur_children = current[klass].get("children", [])
+        for child in mo.get("children", []):
+            if not any(aci_obj_contains(c, child) for c in cur_children):
+                return False
+    return True
+
+
 class Apic(object):
 
     TENANT_OBJECTS = ["ap-kubernetes", "BD-kube-node-bd", "BD-kube-pod-bd", "brc-kube-api", "brc-health-check", "brc-dns", "brc-icmp", "flt-kube-api-filter", "flt-dns-filter", "flt-health-check-filter-out", "flt-icmp-filter", "flt-health-check-filter-in"]
     ACI_PREFIX = aci_prefix
+    # Classes created outside of the cluster tenant that are searched
+    # for leftovers of earlier, possibly failed, runs
+    ORPHAN_CLASSES = ["fvnsVlanInstP", "fvnsMcastAddrInstP", "physDomP", "vmmDomP", "vzFilter", "vzBrCP", "fvBD", "fvAp"]
+    # Of those, the classes that live in a tenant
+    TENANT_ORPHAN_CLASSES = ["vzFilter", "vzBrCP", "fvBD", "fvAp"]
+    # Tenant objects are named <ACI_PREFIX><system_id>-<suffix>
+    CLUSTER_SUFFIXES = ["node-bd", "pod-bd", "api", "api-filter", "dns", "dns-filter", "health-check",
+                        "health-check-filter-in", "health-check-filter-out", "icmp", "icmp-filter", "istio",
+                        "istio-filter", "prometheus-opflex-agent", "prometheus-opflex-agent-filter",
+                        "inter-cluster", "inter-cluster-filter", "nd-ra-policy"]
 
     def __init__(
         self,
@@ -87,6 +201,7 @@ class Apic(object):
         self.username = username
         self.password = password
         self.cookies = apic_cookies.get((addr, username, ssl))
+        self.deleted = []
         self.errors = 0
         self.verify = verify
         self.timeout = timeout if timeout else apic_default_timeout
@@ -132,7 +247,10 @@ class Apic(object):
         args.update(timeout=self.timeout)
         if self.save_to:
             self.saved_deletes[path] = True
-        return requests.delete(self.url(path), **args)
+        resp = requests.delete(self.url(path), **args)
+        if resp.status_code == 200:
+            self.deleted.append(path_dn(path))
+        return resp
 
     def login(self):
         data = '{"aaaUser":{"attributes":{"name": "%s", "pwd": "%s"}}}' % (
@@ -210,6 +328,22 @@ class Apic(object):
         path = "/api/mo/uni/tn-%s/out-%s.json" % (tenant, name)
         return self.get_path(path)
 
+    def get_l3out_extepg(self, tenant, l3out, name):
+        path = "/api/mo/uni/tn-%s/out-%s/instP-%s.json" % (tenant, l3out, name)
+        return self.get_path(path)
+
+    def get_phys_dom(self, name):
+        path = "/api/mo/uni/phys-%s.json" % name
+        return self.get_path(path)
+
+    def get_vmm_dom(self, vmm_type, name):
+        path = "/api/mo/uni/vmmp-%s/dom-%s.json" % (vmm_type, name)
+        return self.get_path(path)
+
+    def get_vlan_encap_blocks(self):
+        path = "/api/node/class/fvnsEncapBlk.json"
+        return self.get_path(path, multi=True) or []
+
     def get_vmmdom_vlanpool_tDn(self, vmmdom):
         path = "/api/node/mo/uni/vmmp-VMware/dom-%s.json?query-target=children&target-subtree-class=infraRsVlanNs" % (vmmdom)
         return self.get_path(path)["infraRsVlanNs"]["attributes"]["tDn"]
@@ -253,9 +387,76 @@ class Apic(object):
                 self.errors += 1
                 err("Error in provisioning %s: %s" % (path, str(e)))
 
+    def diff(self, data):
+        adds, changes = [], []
+        for path, config in data:
+            # The user cert is only posted when its file can be read
+            if config is None or json.loads(config) is None:
+                continue
+            missing = changed = 0
+            units = diff_units(path, json.loads(config))
+            for unit_path, desired in units:
+                klass = list(desired.keys())[0]
+                query = "?rsp-prop-include=config-only"
+                if desired[klass].get("children"):
+                    query += "&rsp-subtree=full"
+                current = self.get_path(unit_path + query)
+                if current is None:
+                    missing += 1
+                elif not aci_obj_contains(current, desired):
+                    changed += 1
+            if missing == len(units):
+                adds.append((path, config))
+            elif missing or changed:
+                changes.append((path, config))
+        return adds, changes
+
+    def get_stale(self, data, system_id, cluster_tenant):
+        # Children of the cluster tenant named after this cluster that
+        # would no longer be generated
+        cluster_tenant_path = "/api/mo/uni/tn-%s.json" % cluster_tenant
+        desired = set()
+        for path, config in data:
+            if path == cluster_tenant_path and config is not None:
+                for mo in json.loads(config).values():
+                    for child in mo.get("children", []):
+                        for klass, val in child.items():
+                            desired.add((klass, val["attributes"].get("name")))
+
+        stale = []
+        names = cluster_names(system_id)
+        children = self.get_path(cluster_tenant_path + "?query-target=children", multi=True)
+        for child in children or []:
+            for klass, val in child.items():
+                name = val["attributes"].get("name")
+                if name in names and (klass, name) not in desired:
+                    stale.append("/api/node/mo/%s.json" % val["attributes"]["dn"])
+        return stale
+
+    def provision_delta(self, data, stale):
+        for path, config in data:
+            try:
+                resp = self.post(path, config)
+                self.check_resp(resp)
+                dbg("%s: %s" % (path, resp.text))
+            except Exception as e:
+                # log it, otherwise ignore it
+                self.errors += 1
+                err("Error in provisioning %s: %s" % (path, str(e)))
+
+        for path in stale:
+            try:
+                resp = self.delete(path)
+                self.check_resp(resp)
+                dbg("%s: %s" % (path, resp.text))
+            except Exception as e:
+                self.errors += 1
+                err("Error in deleting %s: %s" % (path, str(e)))
+
     def unprovision(self, data, system_id, tenant, vrf_tenant, cluster_tenant, old_naming):
         cluster_tenant_path = "/api/mo/uni/tn-%s.json" % cluster_tenant
         shared_resources = ["/api/mo/uni/infra.json", "/api/mo/uni/tn-common.json", cluster_tenant_path]
+        names = cluster_names(system_id) | aci_obj_names(data, self.ORPHAN_CLASSES)
 
         if vrf_tenant not in ["common", system_id]:
             shared_resources.append("/api/mo/uni/tn-%s.json" % vrf_tenant)
@@ -281,7 +482,9 @@ class Apic(object):
                                     del_path = "/api/node/mo/" + val['attributes']['dn'] + ".json"
                                     if 'name' in val['attributes']:
                                         name = val['attributes']['name']
-                                        if (not old_naming) and (system_id in name):
+                                        # Objects the controller creates are
+                                        # named <system_id>_<name>
+                                        if (not old_naming) and (name in names or name.startswith(system_id + "_")):
                                             resp = self.delete(del_path)
                                             self.check_resp(resp)
                                             dbg("%s: %s" % (del_path, resp.text))
@@ -304,6 +507,40 @@ class Apic(object):
 
         # Finally clean any stray resources in common
         self.clean_tagged_resources(system_id, tenant)
+        self.clean_orphans(names, [cluster_tenant, vrf_tenant])
+
+    def get_orphans(self, names, tenants):
+        # Objects carrying our annotation with one of the names this
+        # cluster generates; tenant objects are only searched for in
+        # the given tenants
+        orphans = []
+        query = "query-target-filter=eq(%s.annotation,\"%s\")"
+        for klass in self.ORPHAN_CLASSES:
+            if klass in self.TENANT_ORPHAN_CLASSES:
+                paths = ["/api/node/mo/uni/tn-%s.json?query-target=subtree&target-subtree-class=%s&" % (tenant, klass)
+                         for tenant in collections.OrderedDict.fromkeys(tenants)]
+            else:
+                paths = ["/api/node/class/%s.json?" % klass]
+            for path in paths:
+                for mo in self.get_path(path + query % (klass, aciContainersOwnerAnnotation), multi=True) or []:
+                    attrs = mo[klass]["attributes"]
+                    if attrs.get("name") in names:
+                        orphans.append(attrs["dn"])
+        return orphans
+
+    def clean_orphans(self, names, tenants):
+        for dn in sorted(self.get_orphans(names, tenants), reverse=True):
+            path = "/api/node/mo/%s.json" % dn
+            # Already gone, by itself or with its parent
+            if any(dn == d or dn.startswith(d + "/") for d in self.deleted):
+                continue
+            dbg("Deleting orphan: %s" % dn)
+            try:
+                resp = self.delete(path)
+                self.check_resp(resp)
+            except Exception as e:
+                self.errors += 1
+                err("Error in deleting %s: %s" % (path, str(e)))
 
     def get_apic_version(self):
         path = "/api/node/class/firmwareCtrlrRunning.json"
@@ -2732,6 +2969,9 @@ class ApicKubeConfig(object):
         eade = self.config["kube_config"].get("allow_pods_external_access")
         vmm_type = self.config["aci_config"]["vmm_domain"]["type"]
         v6subnet = self.isV6()
+        secondary_subnets = self.config["net_config"].get("secondary_subnets", {})
+        v6secondary = any(ipaddress.ip_interface(x).version == 6 for x in
+                          [secondary_subnets.get("node_subnet"), secondary_subnets.get("pod_subnet")] if x)
         aci_prefix = "%s%s-" % (self.ACI_PREFIX, system_id)
         kube_prefix = "kube-"
         old_naming = self.config["aci_config"]["use_legacy_kube_naming_convention"]
@@ -2923,26 +3163,26 @@ class ApicKubeConfig(object):
         if eade is True:
             pod_subnet_obj["attributes"]["scope"] = "public"
 
+        ipv6_nd_policy_rs = [
+            collections.OrderedDict(
+                [
+                    (
+                        "fvRsNdPfxPol",
+                        collections.OrderedDict(
+                            [
+                                (
+                                    "attributes",
+                                    collections.OrderedDict(
+                                        [("tnNdPfxPolName", "%snd-ra-policy" % v6_sub_prefix)]
+                                    ),
+                                )
+                            ]
+                        ),
+                    )
+                ]
+            )
+        ]
         if v6subnet:
-            ipv6_nd_policy_rs = [
-                collections.OrderedDict(
-                    [
-                        (
-                            "fvRsNdPfxPol",
-                            collections.OrderedDict(
-                                [
-                                    (
-                                        "attributes",
-                                        collections.OrderedDict(
-                                            [("tnNdPfxPolName", "%snd-ra-policy" % v6_sub_prefix)]
-                                        ),
-                                    )
-                                ]
-                            ),
-                        )
-                    ]
-                )
-            ]
             node_subnet_obj["attributes"]["ctrl"] = "nd"
             node_subnet_obj["children"] = ipv6_nd_policy_rs
             pod_subnet_obj["attributes"]["ctrl"] = "nd"
@@ -4985,7 +5225,27 @@ class ApicKubeConfig(object):
         if eade is not True:
             del data["fvTenant"]["children"][2]["fvBD"]["children"][2]
 
-        if v6subnet is True:
+        # For dual-stack, add the second family next to the BD subnet
+        secondary_bds = [("%spod-bd" % bd_prefix, "pod_subnet", eade is True)]
+        if not disable_node_subnet_creation:
+            secondary_bds.append((node_bd_name, "node_subnet", True))
+        for bd_name, key, public in secondary_bds:
+            subnet = secondary_subnets.get(key)
+            if not subnet:
+                continue
+            subnet_obj = collections.OrderedDict(
+                [("attributes", collections.OrderedDict([("ip", subnet)]))]
+            )
+            if public:
+                subnet_obj["attributes"]["scope"] = "public"
+            if ipaddress.ip_interface(subnet).version == 6:
+                subnet_obj["attributes"]["ctrl"] = "nd"
+                subnet_obj["children"] = ipv6_nd_policy_rs
+            for child in data["fvTenant"]["children"]:
+                if "fvBD" in child.keys() and child["fvBD"]["attributes"]["name"] == bd_name:
+                    child["fvBD"]["children"].insert(1, collections.OrderedDict([("fvSubnet", subnet_obj)]))
+
+        if v6subnet is True or v6secondary:
             data["fvTenant"]["children"].append(
                 collections.OrderedDict(
                     [
@@ -5072,6 +5332,11 @@ class ApicKubeConfig(object):
         # Adding prometheus opflex-agent contract for all flavors
         add_prometheus_opflex_agent_contract(data, epg_prefix, contract_prefix, filter_prefix)
 
+        inter_cluster_peers = self.config["aci_config"]["tenant"].get("inter_cluster_peers")
+        if inter_cluster_peers:
+            peer_contracts = ["%s%s-inter-cluster" % (self.ACI_PREFIX, peer) for peer in inter_cluster_peers]
+            add_inter_cluster_contract(data, epg_prefix, contract_prefix, filter_prefix, peer_contracts)
+
         self.annotateApicObjects(data, pre_existing_tenant)
         return path, data
 
@@ -5125,6 +5390,31 @@ class ApicKubeConfig(object):
         return aci_obj("vzBrCP", [('name', name), ('_children', children)])
 
 
+def add_inter_cluster_contract(data, epg_prefix, contract_prefix, filter_prefix, peer_contracts):
+    # Pods of this cluster provide their own inter-cluster contract and
+    # consume the one of each peer cluster sharing the tenant. Custom
+    # EPGs share the relations of the default EPG.
+    contract_name = "%sinter-cluster" % contract_prefix
+    filter_name = "%sinter-cluster-filter" % filter_prefix
+    ap = data['fvTenant']['children'][0]['fvAp']
+    for child in ap['children']:
+        if child['fvAEPg']['attributes']['name'] == "%sdefault" % epg_prefix:
+            child['fvAEPg']['children'].append(aci_obj("fvRsProv", [('tnVzBrCPName', contract_name)]))
+            for peer_contract in peer_contracts:
+                child['fvAEPg']['children'].append(aci_obj("fvRsCons", [('tnVzBrCPName', peer_contract)]))
+            break
+
+    entry = aci_obj("vzEntry", [('name', "inter-cluster"), ('etherT', "unspecified")])
+    data['fvTenant']['children'].append(
+        aci_obj("vzFilter", [('name', filter_name), ('_children', [entry])]))
+
+    filt = aci_obj("vzRsSubjFiltAtt", [('tnVzFilterName', filter_name)])
+    subj = aci_obj("vzSubj", [('name', "inter-cluster-subj"), ('consMatchT', "AtleastOne"),
+                              ('provMatchT', "AtleastOne"), ('_children', [filt])])
+    data['fvTenant']['children'].append(
+        aci_obj("vzBrCP", [('name', contract_name), ('scope', "tenant"), ('_children', [subj])]))
+
+
 def add_prometheus_opflex_agent_contract(data, epg_prefix, contract_prefix, filter_prefix):
 
     consumer_contract = collections.OrderedDict(
@@ -13,6 +13,7 @@ import json
 
 
 from . import acc_provision
+from . import apic_provision
 from . import fake_apic
 
 
@@ -89,6 +90,116 @@ def test_base_case_ipv6():
     )
 
 
+@in_testdir
+def test_with_external_secret():
+    run_provision(
+        "with_external_secret.inp.yaml",
+        "with_external_secret.kube.yaml",
+        None,
+        None,
+        None
+    )
+
+
+@in_testdir
+def test_external_secret_tar():
+    temp = tempfile.mkdtemp()
+    try:
+        output = os.path.join(temp, "kube.yaml")
+        args = get_args(config="with_external_secret.inp.yaml", output=output,
+                        output_tar=os.path.join(temp, "kube.tar.gz"), aci_operator_cr="-")
+        acc_provision.main(args, no_random=True)
+        with tarfile.open(os.path.join(temp, "kube.tar.gz"), "r:gz") as tar:
+            assert not [name for name in tar.getnames() if "ExternalSecret" in name]
+        with open(os.path.join(temp, "kube-external-secret.yaml")) as fh:
+            docs = list(acc_provision.yaml.safe_load_all(fh))
+        assert [(doc["kind"], doc["metadata"]["name"]) for doc in docs] == [("ExternalSecret", "aci-cert")]
+    finally:
+        shutil.rmtree(temp)
+
+
+@in_testdir
+def test_external_secret_no_path():
+    with tempfile.NamedTemporaryFile("w+") as tmperr:
+        sys.stderr = tmperr
+        try:
+            run_provision(
+                "with_external_secret_no_path.inp.yaml",
+                None,
+                None,
+                None,
+                None
+            )
+        except SystemExit:
+            # expected to exit with errors
+            pass
+        finally:
+            tmperr.flush()
+            sys.stderr = sys.__stderr__
+            tmperr.seek(0)
+        with open("external_secret_no_path.stdout.txt", "r") as stderr:
+            assert tmperr.read() == stderr.read()
+
+
+@in_testdir
+def test_external_secret_rke():
+    with tempfile.NamedTemporaryFile("w+") as tmperr:
+        sys.stderr = tmperr
+        try:
+            run_provision(
+                "with_external_secret_rke.inp.yaml",
+                None,
+                None,
+                None,
+                None,
+                overrides={"flavor": "RKE-1.2.3"}
+            )
+        except SystemExit:
+            # expected to exit with errors
+            pass
+        finally:
+            tmperr.flush()
+            sys.stderr = sys.__stderr__
+            tmperr.seek(0)
+        with open("external_secret_rke.stdout.txt", "r") as stderr:
+            assert tmperr.read() == stderr.read()
+
+
+@in_testdir
+def test_dual_stack_rke():
+    with tempfile.NamedTemporaryFile("w+") as tmperr:
+        sys.stderr = tmperr
+        try:
+            run_provision(
+                "with_dual_stack_rke.inp.yaml",
+                None,
+                None,
+                None,
+                None,
+                overrides={"flavor": "RKE-1.2.3"}
+            )
+        except SystemExit:
+            # expected to exit with errors
+            pass
+        finally:
+            tmperr.flush()
+            sys.stderr = sys.__stderr__
+            tmperr.seek(0)
+        with open("dual_stack_rke.stdout.txt", "r") as stderr:
+            assert tmperr.read() == stderr.read()
+
+
+@in_testdir
+def test_base_case_dual_stack():
+    run_provision(
+        "base_case_dual_stack.inp.yaml",
+        "base_case_dual_stack.kube.yaml",
+        None,
+        None,
+        "base_case_dual_stack.apic.txt"
+    )
+
+
 @in_testdir
 def test_vlan_case():
     run_provision(
@@ -305,6 +416,18 @@ def test_flavor_openshift_46_esx():
     )
 
 
+@in_testdir
+def test_flavor_openshift_46_baremetal():
+    run_provision(
+        "flavor_openshift_46_baremetal.inp.yaml",
+        "flavor_openshift_46_baremetal.kube.yaml",
+        "flavor_openshift_46_baremetal_tar",
+        None,
+        "flavor_openshift_46_baremetal.apic.txt",
+        overrides={"flavor": "openshift-4.6-baremetal"}
+    )
+
+
 @in_testdir
 def test_flavor_openshift_45_esx():
     run_provision(
@@ -341,6 +464,18 @@ def test_flavor_dockerucp_30():
     )
 
 
+@in_testdir
+def test_flavor_kubeadm_ha():
+    run_provision(
+        "flavor_kubeadm_ha.inp.yaml",
+        "flavor_kubeadm_ha.kube.yaml",
+        None,
+        None,
+        "base_case.apic.txt",
+        overrides={"flavor": "kubernetes-1.21-kubeadm-ha"}
+    )
+
+
 @in_testdir
 def test_flavor_localhost():
     run_provision(
@@ -416,6 +551,29 @@ def test_flavor_eks_base():
     apic.shutdown()
 
 
+@in_testdir
+def test_unprovision_apic():
+    with open("apic_unprovision_data.json") as data_file:
+        data = json.loads(data_file.read())
+    apic = fake_apic.start_fake_apic(50003, data["gets"], data["deletes"])
+    with tempfile.NamedTemporaryFile("w+") as tmperr:
+        sys.stderr = tmperr
+        try:
+            args = get_args(config="unprovision.inp.yaml", password="test", delete=True)
+            ret = acc_provision.provision(args, None, True)
+        finally:
+            sys.stderr = sys.__stderr__
+            apic.shutdown()
+        tmperr.seek(0)
+        deleted = [line.split()[-1] for line in tmperr.read().splitlines() if line.startswith("INFO:   ")]
+    assert ret is True
+    # verify all deletes were executed, the peer cluster kube2 and
+    # objects not named after this cluster are left alone
+    assert len(fake_apic.fake_deletes) == 0
+    assert "uni/tn-kube/AbsGraph-kube_svc_global" in deleted
+    assert not [dn for dn in deleted if "kube2" in dn or "kube-old" in dn]
+
+
 @in_testdir
 def test_flavor_cloud_delete():
     with open("apic_delete_data.json") as data_file:
@@ -685,6 +843,113 @@ def test_overlapping_subnets():
             assert tmperr.read() == stderr.read()
 
 
+@in_testdir
+def test_shared_tenant():
+    run_provision(
+        "with_shared_tenant.inp.yaml",
+        "with_shared_tenant.kube.yaml",
+        None,
+        None,
+        "with_shared_tenant.apic.txt"
+    )
+
+
+@in_testdir
+def test_shared_tenant_collision():
+    with tempfile.NamedTemporaryFile("w+") as tmperr:
+        sys.stderr = tmperr
+        try:
+            run_provision(
+                "with_shared_tenant_collision.inp.yaml",
+                None,
+                None,
+                None,
+                None
+            )
+        except SystemExit:
+            # expected to exit with errors
+            pass
+        finally:
+            tmperr.flush()
+            sys.stderr = sys.__stderr__
+            tmperr.seek(0)
+        with open("shared_tenant_collision.stdout.txt", "r") as stderr:
+            assert tmperr.read() == stderr.read()
+
+
+@in_testdir
+def test_shared_tenant_bad_peer():
+    with tempfile.NamedTemporaryFile("w+") as tmperr:
+        sys.stderr = tmperr
+        try:
+            run_provision(
+                "with_shared_tenant_prefix.inp.yaml",
+                None,
+                None,
+                None,
+                None
+            )
+        except SystemExit:
+            # expected to exit with errors
+            pass
+        finally:
+            tmperr.flush()
+            sys.stderr = sys.__stderr__
+            tmperr.seek(0)
+        with open("shared_tenant_bad_peer.stdout.txt", "r") as stderr:
+            assert tmperr.read() == stderr.read()
+
+
+@in_testdir
+def test_peer_clusters_config():
+    config_file = os.path.join(os.getcwd(), "with_shared_tenant.inp.yaml")
+    old_working_directory = os.getcwd()
+    os.chdir(tempfile.gettempdir())
+    try:
+        peers = {"config": "with_shared_tenant_peer.inp.yaml"}
+        config = {"aci_config": {"tenant": {"peer_clusters": [peers]}}}
+        peer = acc_provision.config_peer_clusters(config, config_file)[0]
+        assert peer["system_id"] == "kube2"
+        assert peer["allow_traffic_from"] == ["kube"]
+        assert peer["vmm_domain"]["mcast_range"] == {"start": "225.3.1.1", "end": "225.3.255.255"}
+        peers["config"] = "missing.inp.yaml"
+        assert acc_provision.config_peer_clusters(config, config_file) is None
+        del peers["config"]
+        assert acc_provision.config_peer_clusters(config, config_file) is None
+    finally:
+        os.chdir(old_working_directory)
+
+
+def test_check_peer_clusters():
+    config = {
+        "aci_config": {
+            "system_id": "kube",
+            "tenant": {"name": "shared"},
+            "vmm_domain": {"encap_type": "vlan", "vlan_range": {"start": 100, "end": 200},
+                           "mcast_range": {"start": "225.2.1.1", "end": "225.2.255.255"}},
+        },
+        "net_config": {"kubeapi_vlan": 4001, "service_vlan": 4003, "secondary_subnets": {}},
+    }
+    peer = {
+        "system_id": "kube2",
+        "tenant": "shared",
+        "net_config": {"kubeapi_vlan": 4011, "service_vlan": 4013},
+        "vmm_domain": {"encap_type": "vlan", "vlan_range": {"start": 300, "end": 400},
+                       "mcast_range": {"start": "225.3.1.1", "end": "225.3.255.255"}},
+        "allow_traffic": True,
+        "allow_traffic_from": ["kube"],
+    }
+    assert acc_provision.check_peer_clusters(config, [peer])
+    for change in [
+        # the peer does not provide its inter-cluster contract to us
+        {"allow_traffic_from": []},
+        {"vmm_domain": dict(peer["vmm_domain"], mcast_range={"start": "225.2.128.1", "end": "225.3.0.0"})},
+        {"vmm_domain": dict(peer["vmm_domain"], vlan_range={"start": 150, "end": 160})},
+        {"net_config": {"kubeapi_vlan": 150, "service_vlan": 4013}},
+    ]:
+        assert not acc_provision.check_peer_clusters(config, [dict(peer, **change)])
+
+
 @in_testdir
 def test_preexisting_kube_convention():
     with tempfile.NamedTemporaryFile("w+") as tmperr:
@@ -713,10 +978,14 @@ def get_args(**overrides):
         "output": None,
         "output_tar": None,
         "aci_operator_cr": None,
+        "helm_chart": None,
         "apic_proxy": None,
         "apicfile": None,
         "apic": False,
         "delete": False,
+        "delete_kube": False,
+        "validate": False,
+        "diff": False,
         "username": "admin",
         "password": "",
         "sample": False,
@@ -797,6 +1066,34 @@ def run_provision(inpfile, expectedkube=None, expectedtar=None,
         compare_tar(expectedtar, out_tar.name, args.debug, "/tmp/generated_operator.tar.gz", cleanupFunc)
 
 
+@in_testdir
+def test_helm_chart():
+    with tempfile.NamedTemporaryFile("w+") as output, tempfile.NamedTemporaryFile("w+", suffix=".tgz") as chart:
+        args = get_args(config="base_case.inp.yaml", output=output.name, output_tar="-",
+                        aci_operator_cr="-", helm_chart=chart.name)
+        acc_provision.main(args, no_random=True)
+        copy_file("base_case_helm", chart, args.debug, "/tmp/generated_helm_chart.tgz")
+
+        tmp_dir = "tmp_helm"
+        shutil.rmtree(tmp_dir, ignore_errors=True)
+        try:
+            tarfile.open(mode="r:gz", name=chart.name).extractall(path=tmp_dir)
+            for name in ["Chart.yaml", "values.yaml", "templates/aci-containers.yaml"]:
+                assert filecmp.cmp(os.path.join("base_case_helm", name),
+                                   os.path.join(tmp_dir, "aci-containers", name), shallow=False), name
+        finally:
+            shutil.rmtree(tmp_dir)
+
+
+@in_testdir
+def test_helm_chart_unsupported():
+    for overrides in [{"output": "-"}, {"output": "rke.kube.yaml", "flavor": "RKE-1.2.3"},
+                      {"output": "base_case.kube.yaml", "delete": True}]:
+        args = get_args(config="base_case.inp.yaml", helm_chart="chart.tgz", **overrides)
+        assert acc_provision.provision(args, None, True) is False
+    assert not os.path.exists("chart.tgz")
+
+
 @in_testdir
 def test_certificate_generation_kubernetes():
     create_certificate("base_case.inp.yaml", "user.crt", output='temp.yaml', aci_operator_cr='temp_operator_cr.yaml')
@@ -810,6 +1107,354 @@ def test_normalize_cidr():
     assert ipv6 == '2001::/16'
 
 
+def test_split_host_port():
+    assert acc_provision.split_host_port("10.0.0.1") == ("10.0.0.1", 6443)
+    assert acc_provision.split_host_port("api.example.com:8443") == ("api.example.com", 8443)
+    assert acc_provision.split_host_port("[fd00::1]:8443") == ("fd00::1", 8443)
+    assert acc_provision.split_host_port("[fd00::1]") == ("fd00::1", 6443)
+    for endpoint in ["[fd00::1]junk", "[fd00::1]8443", "host:port"]:
+        try:
+            acc_provision.split_host_port(endpoint)
+            assert False, endpoint
+        except ValueError:
+            pass
+
+
+class FakeValidateApic(object):
+    def __init__(self, missing, vlan_blocks):
+        self.missing = missing
+        self.vlan_blocks = vlan_blocks
+
+    def _lookup(self, key, value):
+        return None if key in self.missing else value
+
+    def get_aep(self, name):
+        return self._lookup("aep", {})
+
+    def get_vrf(self, dn):
+        return self._lookup("vrf", {})
+
+    def get_l3out(self, tenant, name):
+        return self._lookup("l3out", {})
+
+    def get_l3out_extepg(self, tenant, l3out, name):
+        return self._lookup("extepg", {})
+
+    def get_phys_dom(self, name):
+        return self._lookup("pdom", {"physDomP": {"attributes": {"annotation": ""}}})
+
+    def get_vmm_dom(self, vmm_type, name):
+        return self._lookup("nested", {})
+
+    def get_vlan_encap_blocks(self):
+        return self.vlan_blocks
+
+
+def validate_apic_config():
+    return {
+        "aci_config": {
+            "aep": "kube-aep",
+            "vrf": {"tenant": "common", "name": "kube", "dn": "uni/tn-common/ctx-kube"},
+            "l3out": {"name": "l3out", "external_networks": ["default"]},
+            "physical_domain": {"domain": "kube-pdom", "vlan_pool": "kube-pool"},
+            "vmm_domain": {
+                "encap_type": "vxlan",
+                "vlan_pool": "kube-vpool",
+                "nested_inside": {"type": "vmware", "name": "myvmware"},
+            },
+        },
+        "net_config": {"kubeapi_vlan": 4001, "service_vlan": 4003},
+    }
+
+
+def vlan_block(pool, start, end):
+    dn = "uni/infra/vlanns-[%s]-static/from-[vlan-%s]-to-[vlan-%s]" % (pool, start, end)
+    return {"fvnsEncapBlk": {"attributes": {"dn": dn, "from": "vlan-%s" % start, "to": "vlan-%s" % end}}}
+
+
+def test_validate_apic_no_problems():
+    config = validate_apic_config()
+    apic = FakeValidateApic(["pdom"], [vlan_block("kube-pool", 4001, 4001),
+                                       vlan_block("other-pool", 100, 200)])
+    assert acc_provision.config_validate_apic(config, apic) == []
+
+
+def test_validate_apic_problems():
+    config = validate_apic_config()
+    apic = FakeValidateApic(["aep", "extepg", "nested"], [vlan_block("other-pool", 4000, 4002)])
+    problems = acc_provision.config_validate_apic(config, apic)
+    assert [(p["resource"], p["name"]) for p in problems] == [
+        ("aep", "kube-aep"),
+        ("l3out/external_networks", "common/l3out/default"),
+        ("physical_domain", "kube-pdom"),
+        ("vmm_domain/nested_inside", "VMware/myvmware"),
+        ("vlan", "net_config/kubeapi_vlan"),
+    ]
+
+
+@in_testdir
+def test_validate_apic_exclusive():
+    for overrides in [{"apic": True}, {"delete": True}, {"diff": True}]:
+        args = get_args(config="base_case.inp.yaml", validate=True, **overrides)
+        assert acc_provision.provision(args, None, True) is False
+
+
+@in_testdir
+def test_diff_kube_yaml():
+    with open("base_case.kube.yaml", "r") as fh:
+        docs = [doc for doc in acc_provision.yaml.safe_load_all(fh) if doc]
+    removed = docs.pop()
+    docs[0]["metadata"]["labels"] = {"changed": "true"}
+    docs.append({"kind": "ConfigMap", "metadata": {"name": "added", "namespace": "kube-system"}})
+    changes = acc_provision.diff_kube_yaml("base_case.kube.yaml", acc_provision.yaml.safe_dump_all(docs))
+    assert changes == [
+        "~ %s %s" % (docs[0]["kind"], docs[0]["metadata"]["name"]),
+        "+ ConfigMap kube-system/added",
+        "- %s %s/%s" % (removed["kind"], removed["metadata"]["namespace"], removed["metadata"]["name"]),
+    ]
+
+
+class FakeDiffApic(apic_provision.Apic):
+    def __init__(self, objects):
+        self.objects = objects
+        self.errors = 0
+
+    def get_path(self, path, multi=False):
+        for key in [path, path.split("&query-target-filter")[0], path.split("?")[0]]:
+            if key in self.objects:
+                return self.objects[key]
+        return None
+
+
+def test_diff_apic():
+    bd = {"fvBD": {"attributes": {"name": "kube-pod-bd", "arpFlood": "yes"}}}
+    tenant = {"fvTenant": {"attributes": {"name": "kube", "dn": "uni/tn-kube"}, "children": [bd]}}
+    apic_config = [
+        ("/api/mo/uni/tn-kube.json", json.dumps(tenant)),
+        ("/api/mo/uni/tn-common/flt-kube-allow-all-filter.json", json.dumps({"vzFilter": {"attributes": {"name": "kube-allow-all-filter"}}})),
+        ("/api/mo/uni/phys-kube-pdom.json", json.dumps({"physDomP": {"attributes": {"name": "kube-pdom", "status": "created"}}})),
+        ("/api/mo/uni/userext/user-kube.json", None),
+    ]
+    apic = FakeDiffApic({
+        "/api/mo/uni/tn-kube.json": {"fvTenant": {"attributes": {"name": "kube"}}},
+        "/api/mo/uni/tn-kube/BD-kube-pod-bd.json": {"fvBD": {"attributes": {"name": "kube-pod-bd", "arpFlood": "no"}}},
+        "/api/mo/uni/phys-kube-pdom.json": {"physDomP": {"attributes": {"name": "kube-pdom", "annotation": ""}}},
+    })
+    adds, changes = apic.diff(apic_config)
+    assert [path for path, _ in adds] == ["/api/mo/uni/tn-common/flt-kube-allow-all-filter.json"]
+    assert [path for path, _ in changes] == ["/api/mo/uni/tn-kube.json"]
+
+
+def test_get_stale_apic():
+    tenant = {"fvTenant": {"attributes": {"name": "kube"}, "children": [
+        {"fvBD": {"attributes": {"name": "aci-containers-kube-pod-bd"}}},
+    ]}}
+    apic = FakeDiffApic({
+        "/api/mo/uni/tn-kube.json": [
+            {"fvBD": {"attributes": {"name": "aci-containers-kube-pod-bd", "dn": "uni/tn-kube/BD-aci-containers-kube-pod-bd"}}},
+            {"vzBrCP": {"attributes": {"name": "aci-containers-kube-istio", "dn": "uni/tn-kube/brc-aci-containers-kube-istio"}}},
+            {"fvBD": {"attributes": {"name": "other-bd", "dn": "uni/tn-kube/BD-other-bd"}}},
+        ],
+    })
+    stale = apic.get_stale([("/api/mo/uni/tn-kube.json", json.dumps(tenant))], "kube", "kube")
+    assert stale == ["/api/node/mo/uni/tn-kube/brc-aci-containers-kube-istio.json"]
+
+
+def test_get_stale_apic_peer_cluster():
+    tenant = {"fvTenant": {"attributes": {"name": "shared"}, "children": [
+        {"fvBD": {"attributes": {"name": "aci-containers-kube-pod-bd"}}},
+    ]}}
+    apic = FakeDiffApic({
+        "/api/mo/uni/tn-shared.json": [
+            {"fvBD": {"attributes": {"name": "aci-containers-kube-pod-bd", "dn": "uni/tn-shared/BD-aci-containers-kube-pod-bd"}}},
+            {"fvBD": {"attributes": {"name": "aci-containers-kube2-pod-bd", "dn": "uni/tn-shared/BD-aci-containers-kube2-pod-bd"}}},
+            {"fvBD": {"attributes": {"name": "aci-containers-kube-prod-pod-bd",
+                                     "dn": "uni/tn-shared/BD-aci-containers-kube-prod-pod-bd"}}},
+            {"vzBrCP": {"attributes": {"name": "aci-containers-kube-prod-inter-cluster",
+                                       "dn": "uni/tn-shared/brc-aci-containers-kube-prod-inter-cluster"}}},
+        ],
+    })
+    assert apic.get_stale([("/api/mo/uni/tn-shared.json", json.dumps(tenant))], "kube", "shared") == []
+
+
+@in_testdir
+def test_diff_no_cert_generation():
+    temp = tempfile.mkdtemp()
+    old_working_directory = os.getcwd()
+    for name in ["flavor_localhost.inp.yaml", "flavor_localhost.kube.yaml"]:
+        shutil.copyfile(name, os.path.join(temp, name))
+    os.chdir(temp)
+    try:
+        args = get_args(config="flavor_localhost.inp.yaml", output="flavor_localhost.kube.yaml",
+                        flavor="k8s-overlay", diff=True)
+        acc_provision.main(args, no_random=True)
+        assert sorted(os.listdir(temp)) == ["flavor_localhost.inp.yaml", "flavor_localhost.kube.yaml"]
+    finally:
+        os.chdir(old_working_directory)
+        shutil.rmtree(temp)
+
+
+@in_testdir
+def test_diff_no_cert_files():
+    # Without the cert files the Secret is compared with the certs of
+    # the existing deployment
+    with open("apic_diff_data.json") as data_file:
+        data = json.loads(data_file.read())
+    apic = fake_apic.start_fake_apic(50003, data["gets"], data["deletes"])
+    temp = tempfile.mkdtemp()
+    old_working_directory = os.getcwd()
+    for name in ["base_case_diff.inp.yaml", "base_case_diff.kube.yaml"]:
+        shutil.copyfile(name, os.path.join(temp, name))
+    os.chdir(temp)
+    try:
+        with tempfile.NamedTemporaryFile("w+") as tmpout:
+            sys.stdout = tmpout
+            try:
+                args = get_args(config="base_case_diff.inp.yaml", output="base_case_diff.kube.yaml",
+                                password="test", diff=True)
+                ret = acc_provision.provision(args, None, True)
+            finally:
+                sys.stdout = sys.__stdout__
+            tmpout.seek(0)
+            diff = [line for line in tmpout.read().splitlines() if line[:2] in ["+ ", "~ ", "- "]]
+        assert ret is True
+        assert diff == [], diff
+        assert sorted(os.listdir(temp)) == ["base_case_diff.inp.yaml", "base_case_diff.kube.yaml"]
+    finally:
+        apic.shutdown()
+        os.chdir(old_working_directory)
+        shutil.rmtree(temp)
+
+
+@in_testdir
+def test_diff_apic_unchanged():
+    # Each posted object is looked up at its own dn, so a second run
+    # against what the first one provisioned has nothing to report
+    with open("apic_diff_data.json") as data_file:
+        data = json.loads(data_file.read())
+    apic = fake_apic.start_fake_apic(50003, data["gets"], data["deletes"])
+    with tempfile.NamedTemporaryFile("w+") as tmpout:
+        sys.stdout = tmpout
+        try:
+            args = get_args(config="base_case_diff.inp.yaml", output="base_case_diff.kube.yaml",
+                            password="test", diff=True)
+            ret = acc_provision.provision(args, None, True)
+        finally:
+            sys.stdout = sys.__stdout__
+            apic.shutdown()
+        tmpout.seek(0)
+        diff = [line for line in tmpout.read().splitlines() if line[:2] in ["+ ", "~ ", "- "]]
+    assert ret is True
+    assert diff == [], diff
+
+
+def test_get_orphans_apic():
+    annotation = apic_provision.aciContainersOwnerAnnotation
+    tenant_query = "/api/node/mo/uni/tn-%s.json?query-target=subtree&target-subtree-class=%s"
+    apic = FakeDiffApic({
+        "/api/node/class/fvnsVlanInstP.json": [
+            {"fvnsVlanInstP": {"attributes": {"name": "kube-pool", "dn": "uni/infra/vlanns-[kube-pool]-static"}}},
+            {"fvnsVlanInstP": {"attributes": {"name": "kube2-pool", "dn": "uni/infra/vlanns-[kube2-pool]-static"}}},
+            {"fvnsVlanInstP": {"attributes": {"name": "kube-prod-pool", "dn": "uni/infra/vlanns-[kube-prod-pool]-static"}}},
+        ],
+        "/api/node/class/vmmDomP.json": [
+            {"vmmDomP": {"attributes": {"name": "kube", "dn": "uni/vmmp-Kubernetes/dom-kube", "annotation": annotation}}},
+            {"vmmDomP": {"attributes": {"name": "kube-prod", "dn": "uni/vmmp-Kubernetes/dom-kube-prod"}}},
+        ],
+        tenant_query % ("kube", "fvAp"): [
+            {"fvAp": {"attributes": {"name": "aci-containers-kube", "dn": "uni/tn-kube/ap-aci-containers-kube"}}},
+        ],
+        tenant_query % ("kube", "fvBD"): [
+            {"fvBD": {"attributes": {"name": "aci-containers-kube-pod-bd", "dn": "uni/tn-kube/BD-aci-containers-kube-pod-bd"}}},
+            {"fvBD": {"attributes": {"name": "aci-containers-kube-prod-pod-bd",
+                                     "dn": "uni/tn-kube/BD-aci-containers-kube-prod-pod-bd"}}},
+        ],
+        tenant_query % ("other", "fvBD"): [
+            {"fvBD": {"attributes": {"name": "aci-containers-kube-node-bd", "dn": "uni/tn-other/BD-aci-containers-kube-node-bd"}}},
+        ],
+    })
+    names = apic_provision.cluster_names("kube")
+    assert apic.get_orphans(names, ["kube", "common"]) == [
+        "uni/infra/vlanns-[kube-pool]-static",
+        "uni/vmmp-Kubernetes/dom-kube",
+        "uni/tn-kube/BD-aci-containers-kube-pod-bd",
+        "uni/tn-kube/ap-aci-containers-kube",
+    ]
+
+
+class FakeDeleteApic(FakeDiffApic):
+    def __init__(self, objects):
+        super(FakeDeleteApic, self).__init__(objects)
+        self.cookies = None
+        self.verify = False
+        self.timeout = None
+        self.save_to = None
+        self.deleted = []
+        self.deletes = []
+
+    def get(self, path, data=None, params=None):
+        obj = self.objects.get(path)
+        return FakeResponse([obj] if obj else [])
+
+    def url(self, path):
+        return path
+
+
+class FakeResponse(object):
+    def __init__(self, imdata):
+        self.status_code = 200
+        self.text = json.dumps({"imdata": imdata})
+
+
+def test_clean_orphans_apic():
+    bd = "uni/tn-kube/BD-aci-containers-kube-pod-bd"
+    pool = "uni/infra/vlanns-[kube-pool]-static"
+    mpool = "uni/infra/maddrns-kube-mpool"
+    apic = FakeDeleteApic({
+        "/api/mo/uni/tn-kube.json": {"fvTenant": {"attributes": {"dn": "uni/tn-kube"}}},
+        "/api/mo/%s.json" % pool: {"fvnsVlanInstP": {"attributes": {"dn": pool}}},
+        "/api/node/mo/%s.json" % mpool: {"fvnsMcastAddrInstP": {"attributes": {"dn": mpool}}},
+        "/api/node/class/fvnsVlanInstP.json": [
+            {"fvnsVlanInstP": {"attributes": {"name": "kube-pool", "dn": pool}}},
+        ],
+        "/api/node/class/fvnsMcastAddrInstP.json": [
+            {"fvnsMcastAddrInstP": {"attributes": {"name": "kube-mpool", "dn": mpool}}},
+        ],
+        "/api/node/mo/uni/tn-kube.json?query-target=subtree&target-subtree-class=fvBD": [
+            {"fvBD": {"attributes": {"name": "aci-containers-kube-pod-bd", "dn": bd}}},
+        ],
+    })
+    requests_delete = apic_provision.requests.delete
+    apic_provision.requests.delete = lambda url, **kwargs: apic.deletes.append(url) or FakeResponse([])
+    try:
+        apic.delete("/api/mo/uni/tn-kube.json")
+        apic.delete("/api/mo/%s.json" % pool)
+        apic.delete("/api/mo/uni/phys-kube-pdom.json")
+        apic.clean_orphans(apic_provision.cluster_names("kube"), ["kube"])
+    finally:
+        apic_provision.requests.delete = requests_delete
+    # the BD went with its tenant, the pool was deleted by its /api/mo path
+    assert apic.deletes == [
+        "/api/mo/uni/tn-kube.json",
+        "/api/mo/%s.json" % pool,
+        "/api/mo/uni/phys-kube-pdom.json",
+        "/api/node/mo/%s.json" % mpool,
+    ]
+    assert apic.deleted == ["uni/tn-kube", pool, "uni/phys-kube-pdom", mpool]
+
+
+def test_delete_kube_resources():
+    assert acc_provision.delete_kube_resources({"kube_config": {"kubectl": "true"}}, "kube.yaml")
+    assert not acc_provision.delete_kube_resources({"kube_config": {"kubectl": "false"}}, "kube.yaml")
+
+
+@in_testdir
+def test_delete_kube_unsupported_flavor():
+    args = get_args(config="flavor_localhost.inp.yaml", flavor="k8s-overlay", output="kube.yaml",
+                    delete=True, delete_kube=True)
+    assert acc_provision.provision(args, None, True) is False
+
+
 def create_certificate(input_file, cert_file, **overrides):
     temp = tempfile.mkdtemp()
     old_working_directory = os.getcwd()